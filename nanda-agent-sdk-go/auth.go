@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Claims is the payload of a NANDA token: a JWT-like structure (header-less,
+// HMAC-signed) carrying the subject, its granted scopes, and expiry.
+type Claims struct {
+	Sub    string   `json:"sub"`
+	Scopes []string `json:"scopes"`
+	Exp    int64    `json:"exp"`
+	Iat    int64    `json:"iat"`
+	Jti    string   `json:"jti"`
+}
+
+func (c Claims) hasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope || s == "admin" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Claims) expired() bool {
+	return time.Now().Unix() >= c.Exp
+}
+
+type ctxKey int
+
+const claimsCtxKey ctxKey = 0
+
+func claimsFromContext(ctx context.Context) (Claims, bool) {
+	c, ok := ctx.Value(claimsCtxKey).(Claims)
+	return c, ok
+}
+
+// authSecret returns the HMAC signing key from NANDA_SECRET, or "" if auth
+// is not configured. When unset, authMiddleware is a no-op so deployments
+// that haven't opted in keep working unauthenticated, same as CERT_FILE and
+// RULES_FILE being optional elsewhere in this agent.
+func authSecret() string {
+	return os.Getenv("NANDA_SECRET")
+}
+
+func newJti() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func signToken(secret string, c Claims) string {
+	payload, _ := json.Marshal(c)
+	payloadB64 := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payloadB64))
+	sig := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	return payloadB64 + "." + sig
+}
+
+func parseToken(secret, token string) (Claims, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return Claims{}, fmt.Errorf("malformed token")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parts[0]))
+	wantSig := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if subtle.ConstantTimeCompare([]byte(wantSig), []byte(parts[1])) != 1 {
+		return Claims{}, fmt.Errorf("invalid signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Claims{}, fmt.Errorf("invalid payload encoding")
+	}
+	var c Claims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return Claims{}, fmt.Errorf("invalid payload")
+	}
+	if c.expired() {
+		return Claims{}, fmt.Errorf("token expired")
+	}
+	return c, nil
+}
+
+// revocationSet holds blacklisted token ids, each with its own expiry so
+// entries are dropped once the token would have expired anyway.
+type revocationSet struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+func newRevocationSet() *revocationSet {
+	return &revocationSet{revoked: map[string]time.Time{}}
+}
+
+func (rs *revocationSet) revoke(jti string, until time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.revoked[jti] = until
+}
+
+func (rs *revocationSet) isRevoked(jti string) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	until, ok := rs.revoked[jti]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(rs.revoked, jti)
+		return false
+	}
+	return true
+}
+
+var revocations = newRevocationSet()
+
+// rateBucket is a per-subject fixed-window counter, so one noisy token can't
+// starve the shared budget the old single global counter enforced.
+type rateBucket struct {
+	mu    sync.Mutex
+	min   int64
+	count int
+}
+
+var rateBuckets sync.Map // subject (string) -> *rateBucket
+
+func rateOKFor(subject string) bool {
+	v, _ := rateBuckets.LoadOrStore(subject, &rateBucket{})
+	b := v.(*rateBucket)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	nowMin := time.Now().Unix() / 60
+	if nowMin != b.min {
+		b.min = nowMin
+		b.count = 0
+	}
+	if b.count >= ratePerMin {
+		return false
+	}
+	b.count++
+	return true
+}
+
+// requestSubject identifies who a request should be rate-limited and
+// attributed as: the authenticated subject if present, else the caller-
+// supplied agent id, else its IP.
+func requestSubject(r *http.Request) string {
+	if c, ok := claimsFromContext(r.Context()); ok {
+		return c.Sub
+	}
+	if id := r.Header.Get("X-Agent-Id"); id != "" {
+		return id
+	}
+	return clientIP(r)
+}
+
+// authMiddleware enforces Bearer token auth and a required scope on h. If
+// NANDA_SECRET isn't set, auth is considered unconfigured and requests pass
+// through unchanged.
+func authMiddleware(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := authSecret()
+		if secret == "" {
+			h(w, r)
+			return
+		}
+		authz := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authz, "Bearer ") {
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		token := strings.TrimPrefix(authz, "Bearer ")
+		claims, err := parseToken(secret, token)
+		if err != nil {
+			http.Error(w, "invalid token: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if revocations.isRevoked(claims.Jti) {
+			http.Error(w, "token revoked", http.StatusUnauthorized)
+			return
+		}
+		if scope != "" && !claims.hasScope(scope) {
+			http.Error(w, "insufficient scope", http.StatusForbidden)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), claimsCtxKey, claims)))
+	}
+}
+
+func authTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	secret := authSecret()
+	if secret == "" {
+		http.Error(w, "auth not configured (NANDA_SECRET unset)", http.StatusServiceUnavailable)
+		return
+	}
+	var req struct {
+		Sub    string   `json:"sub"`
+		Scopes []string `json:"scopes"`
+		TTLSec int64    `json:"ttl_sec"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if req.Sub == "" || len(req.Scopes) == 0 {
+		http.Error(w, "sub and scopes are required", http.StatusBadRequest)
+		return
+	}
+	ttl := req.TTLSec
+	if ttl <= 0 {
+		ttl = int64((1 * time.Hour).Seconds())
+	}
+	now := time.Now()
+	claims := Claims{Sub: req.Sub, Scopes: req.Scopes, Iat: now.Unix(), Exp: now.Unix() + ttl, Jti: newJti()}
+	token := signToken(secret, claims)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"token": token, "exp": claims.Exp, "jti": claims.Jti})
+}
+
+func authRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	secret := authSecret()
+	if secret == "" {
+		http.Error(w, "auth not configured (NANDA_SECRET unset)", http.StatusServiceUnavailable)
+		return
+	}
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		http.Error(w, "missing bearer token", http.StatusUnauthorized)
+		return
+	}
+	remaining := time.Until(time.Unix(claims.Exp, 0))
+	revocations.revoke(claims.Jti, time.Now().Add(remaining))
+
+	now := time.Now()
+	ttl := claims.Exp - claims.Iat
+	next := Claims{Sub: claims.Sub, Scopes: claims.Scopes, Iat: now.Unix(), Exp: now.Unix() + ttl, Jti: newJti()}
+	token := signToken(secret, next)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"token": token, "exp": next.Exp, "jti": next.Jti})
+}
+
+// meshToken mints a short-lived token for this node's own outbound mesh
+// calls (federation sync, send-forward), scoped to a single permission.
+// Mesh nodes are assumed to share the same NANDA_SECRET, same as any other
+// HMAC-trust deployment of this agent; if auth isn't configured, it returns
+// "" and callers skip the Authorization header entirely.
+func meshToken(scope string) string {
+	secret := authSecret()
+	if secret == "" {
+		return ""
+	}
+	now := time.Now()
+	claims := Claims{Sub: "mesh", Scopes: []string{scope}, Iat: now.Unix(), Exp: now.Unix() + 30, Jti: newJti()}
+	return signToken(secret, claims)
+}
+
+// bootstrapAdminToken mints and logs a one-off admin token on startup so an
+// operator can reach /api/auth/token without a prior token to authenticate
+// with. It is only emitted, never stored server-side beyond its own claims.
+func bootstrapAdminToken() {
+	secret := authSecret()
+	if secret == "" {
+		log.Printf("NANDA_SECRET not set: /api/* auth is disabled")
+		return
+	}
+	now := time.Now()
+	claims := Claims{Sub: "bootstrap", Scopes: []string{"admin"}, Iat: now.Unix(), Exp: now.Unix() + int64((1 * time.Hour).Seconds()), Jti: newJti()}
+	token := signToken(secret, claims)
+	log.Printf("auth enabled; bootstrap admin token (expires in 1h): %s", token)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignAndParseTokenRoundTrip(t *testing.T) {
+	secret := "test-secret"
+	now := time.Now()
+	claims := Claims{Sub: "alice", Scopes: []string{"send"}, Iat: now.Unix(), Exp: now.Unix() + 60, Jti: newJti()}
+
+	token := signToken(secret, claims)
+	got, err := parseToken(secret, token)
+	if err != nil {
+		t.Fatalf("parseToken() error = %v", err)
+	}
+	if got.Sub != claims.Sub || got.Jti != claims.Jti {
+		t.Fatalf("parseToken() = %+v, want %+v", got, claims)
+	}
+	if !got.hasScope("send") {
+		t.Fatalf("claims should have scope %q", "send")
+	}
+	if got.hasScope("admin") {
+		t.Fatalf("claims should not have scope %q", "admin")
+	}
+}
+
+func TestParseTokenRejectsExpired(t *testing.T) {
+	secret := "test-secret"
+	now := time.Now()
+	claims := Claims{Sub: "alice", Scopes: []string{"send"}, Iat: now.Unix() - 120, Exp: now.Unix() - 60, Jti: newJti()}
+	token := signToken(secret, claims)
+
+	if _, err := parseToken(secret, token); err == nil {
+		t.Fatal("parseToken() on expired token: want error, got nil")
+	}
+}
+
+func TestParseTokenRejectsTamperedSignature(t *testing.T) {
+	secret := "test-secret"
+	now := time.Now()
+	claims := Claims{Sub: "alice", Scopes: []string{"send"}, Iat: now.Unix(), Exp: now.Unix() + 60, Jti: newJti()}
+	token := signToken(secret, claims)
+
+	if _, err := parseToken("a-different-secret", token); err == nil {
+		t.Fatal("parseToken() with wrong secret: want error, got nil")
+	}
+}
+
+func TestRevocationSet(t *testing.T) {
+	rs := newRevocationSet()
+	if rs.isRevoked("abc") {
+		t.Fatal("isRevoked() on unknown jti = true, want false")
+	}
+
+	rs.revoke("abc", time.Now().Add(50*time.Millisecond))
+	if !rs.isRevoked("abc") {
+		t.Fatal("isRevoked() right after revoke() = false, want true")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if rs.isRevoked("abc") {
+		t.Fatal("isRevoked() after entry's own expiry = true, want false")
+	}
+}
+
+func TestAdminScopeImpliesAllScopes(t *testing.T) {
+	c := Claims{Scopes: []string{"admin"}}
+	for _, scope := range []string{"send", "render", "agents:read", "agents:write", "admin"} {
+		if !c.hasScope(scope) {
+			t.Fatalf("admin claims should satisfy scope %q", scope)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	rateLimitRejections int64
+	processDurationCount int64
+	processDurationSumMs int64
+)
+
+func recordProcessDuration(d time.Duration) {
+	atomic.AddInt64(&processDurationCount, 1)
+	atomic.AddInt64(&processDurationSumMs, d.Milliseconds())
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	if v := os.Getenv(name); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
+func envInt(name string, def int) int {
+	if v := os.Getenv(name); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+// newServer builds the http.Server with k8s-friendly timeouts, all
+// overridable via env so a deployment can tune them without a rebuild.
+func newServer(addr string, mux http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: envDuration("READ_HEADER_TIMEOUT", 5*time.Second),
+		IdleTimeout:       envDuration("IDLE_TIMEOUT", 120*time.Second),
+		MaxHeaderBytes:    envInt("MAX_HEADER_BYTES", 1<<20),
+	}
+}
+
+// shutdownGrace is how long Shutdown waits for in-flight requests (notably
+// /api/send) to drain before giving up and forcing close.
+func shutdownGrace() time.Duration {
+	return envDuration("SHUTDOWN_GRACE", 15*time.Second)
+}
+
+// livezHandler reports whether the process itself is alive. It must never
+// depend on downstream state, so a k8s liveness probe never restarts a pod
+// that's merely waiting on a slow peer.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":"ok"}`)
+}
+
+// readyzHandler reports whether the agent can actually serve traffic: the
+// message store is open, the rate limiter is initialized, and (if peers are
+// configured) at least one is reachable.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]bool{
+		"store":        store != nil,
+		"rate_limiter": ratePerMin > 0,
+	}
+	if peers := peerHosts(); len(peers) > 0 {
+		checks["peers"] = anyPeerReachable(peers)
+	}
+	ready := true
+	for _, ok := range checks {
+		if !ok {
+			ready = false
+			break
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]any{"ready": ready, "checks": checks})
+}
+
+func anyPeerReachable(peers []string) bool {
+	client := http.Client{Timeout: 2 * time.Second}
+	for _, peer := range peers {
+		resp, err := client.Get(peer + "/api/livez")
+		if err == nil {
+			resp.Body.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// metricsHandler emits a minimal Prometheus text-exposition payload. No
+// external client library is vendored, so this hand-rolls the counters and
+// gauges the rest of the agent already tracks.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	messages := msgCount
+	mu.Unlock()
+
+	rejections := atomic.LoadInt64(&rateLimitRejections)
+	procCount := atomic.LoadInt64(&processDurationCount)
+	procSumMs := atomic.LoadInt64(&processDurationSumMs)
+	storeSize := 0
+	if store != nil {
+		storeSize = store.Size()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP nanda_messages_total Total messages processed by sendHandler.\n")
+	fmt.Fprintf(w, "# TYPE nanda_messages_total counter\n")
+	fmt.Fprintf(w, "nanda_messages_total %d\n", messages)
+
+	fmt.Fprintf(w, "# HELP nanda_rate_limit_rejections_total Requests rejected by the rate limiter.\n")
+	fmt.Fprintf(w, "# TYPE nanda_rate_limit_rejections_total counter\n")
+	fmt.Fprintf(w, "nanda_rate_limit_rejections_total %d\n", rejections)
+
+	fmt.Fprintf(w, "# HELP nanda_processor_duration_ms_sum Sum of pipeline processing time in milliseconds.\n")
+	fmt.Fprintf(w, "# TYPE nanda_processor_duration_ms_sum counter\n")
+	fmt.Fprintf(w, "nanda_processor_duration_ms_sum %d\n", procSumMs)
+	fmt.Fprintf(w, "# HELP nanda_processor_duration_ms_count Number of pipeline runs observed.\n")
+	fmt.Fprintf(w, "# TYPE nanda_processor_duration_ms_count counter\n")
+	fmt.Fprintf(w, "nanda_processor_duration_ms_count %d\n", procCount)
+
+	fmt.Fprintf(w, "# HELP nanda_store_size Number of messages currently held in the store.\n")
+	fmt.Fprintf(w, "# TYPE nanda_store_size gauge\n")
+	fmt.Fprintf(w, "nanda_store_size %d\n", storeSize)
+}
+
+// certWatcher polls certFile/keyFile for changes and atomically swaps the
+// tls.Certificate served by GetCertificate, so a renewed cert can be picked
+// up without restarting the process. Polling is used instead of fsnotify
+// since no file-watching dependency is vendored in this repo.
+type certWatcher struct {
+	certFile, keyFile string
+	cert              atomic.Value // holds *tls.Certificate
+	lastMod           time.Time
+}
+
+func newCertWatcher(certFile, keyFile string) (*certWatcher, error) {
+	cw := &certWatcher{certFile: certFile, keyFile: keyFile}
+	if err := cw.reload(); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *certWatcher) reload() error {
+	cert, err := tls.LoadX509KeyPair(cw.certFile, cw.keyFile)
+	if err != nil {
+		return err
+	}
+	cw.cert.Store(&cert)
+	if info, err := os.Stat(cw.certFile); err == nil {
+		cw.lastMod = info.ModTime()
+	}
+	return nil
+}
+
+func (cw *certWatcher) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cw.cert.Load().(*tls.Certificate), nil
+}
+
+// watch polls for certFile changes every interval until ctx is done.
+func (cw *certWatcher) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(cw.certFile)
+			if err != nil || !info.ModTime().After(cw.lastMod) {
+				continue
+			}
+			if err := cw.reload(); err != nil {
+				log.Printf("tls: could not reload %s/%s: %v", cw.certFile, cw.keyFile, err)
+				continue
+			}
+			log.Printf("tls: reloaded certificate from %s", cw.certFile)
+		}
+	}
+}
+
+func tlsWatchInterval() time.Duration {
+	return envDuration("TLS_WATCH_INTERVAL", 5*time.Second)
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -32,20 +37,14 @@ type RenderResponse struct {
 	Latest string `json:"latest"`
 }
 
-type AgentInfo struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
-}
-
 var (
-	start       = time.Now()
-	msgCount    int64
-	lastMsg     string
-	mu          sync.Mutex
-	memFile     = "memory.json"
-	ratePerMin  = 60
-	bucketMin   int64
-	bucketCount int
+	start      = time.Now()
+	msgCount   int64
+	mu         sync.Mutex
+	memFile    = "memory.json"
+	ratePerMin = 60
+	router     = NewRouter()
+	store      Store
 )
 
 type memory struct {
@@ -82,19 +81,6 @@ func improve(s string) string {
 	return "[nanda-go] " + out
 }
 
-func rateOK() bool {
-	nowBucket := time.Now().Unix() / 60
-	if nowBucket != bucketMin {
-		bucketMin = nowBucket
-		bucketCount = 0
-	}
-	if bucketCount >= ratePerMin {
-		return false
-	}
-	bucketCount++
-	return true
-}
-
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	mu.Lock()
 	defer mu.Unlock()
@@ -115,10 +101,9 @@ func sendHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	mu.Lock()
-	defer mu.Unlock()
 
-	if !rateOK() {
+	if !rateOKFor(requestSubject(r)) {
+		atomic.AddInt64(&rateLimitRejections, 1)
 		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
 		return
 	}
@@ -129,9 +114,59 @@ func sendHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	out := improve(req.Message)
-	lastMsg = out
+	sourceAgent := r.Header.Get("X-Agent-Id")
+
+	// Persist before processing so a crash mid-chain can be replayed on restart.
+	pending := StoredMessage{
+		Seq:         store.NextSeq(),
+		TS:          time.Now(),
+		SourceAgent: sourceAgent,
+		Input:       req.Message,
+		Status:      StatusPending,
+	}
+	if err := store.Put(pending); err != nil {
+		http.Error(w, "could not persist message: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	chain, ruleName := router.RouteNamed(sourceAgent, req.Message)
+	began := time.Now()
+	out, procErr := Run(r.Context(), chain, req.Message)
+	duration := time.Since(began)
+	recordProcessDuration(duration)
+
+	final := pending
+	if procErr != nil {
+		final.Status = StatusFailed
+		final.Error = procErr.Error()
+	} else {
+		final.Status = StatusDone
+		final.Output = out
+	}
+	if err := store.Put(final); err != nil {
+		log.Printf("could not persist seq %d: %v", final.Seq, err)
+	}
+
+	traffic.Observe(TrafficEvent{
+		Seq:        final.Seq,
+		TS:         final.TS.Unix(),
+		Input:      req.Message,
+		Output:     out,
+		Processor:  ruleName,
+		DurationMS: duration.Milliseconds(),
+		ClientIP:   clientIP(r),
+		BytesIn:    int64(len(req.Message)),
+		BytesOut:   int64(len(out)),
+	})
+
+	if procErr != nil {
+		http.Error(w, "processing failed: "+procErr.Error(), http.StatusBadGateway)
+		return
+	}
+
+	mu.Lock()
 	msgCount++
+	mu.Unlock()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(SendResponse{
@@ -148,26 +183,47 @@ func sendHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func renderHandler(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
-	defer mu.Unlock()
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(RenderResponse{Latest: lastMsg})
+	json.NewEncoder(w).Encode(RenderResponse{Latest: traffic.Latest()})
 }
 
 func agentsListHandler(w http.ResponseWriter, r *http.Request) {
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode([]AgentInfo{
-        {ID: "harshit-go-agent", Name: "nanda-go-agent"},
-    })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(registry.List())
 }
 
-
 func main() {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/health", healthHandler)
-	mux.HandleFunc("/api/send", sendHandler)
-	mux.HandleFunc("/api/render", renderHandler)
-	mux.HandleFunc("/api/agents/list", agentsListHandler)
+	mux.HandleFunc("/api/health", authMiddleware("", healthHandler))
+	mux.HandleFunc("/api/send", authMiddleware("send", sendHandler))
+	mux.HandleFunc("/api/render", authMiddleware("render", renderHandler))
+	mux.HandleFunc("/api/agents/list", authMiddleware("agents:read", agentsListHandler))
+	mux.HandleFunc("/api/rules/reload", authMiddleware("admin", rulesReloadHandler))
+	mux.HandleFunc("/api/messages", authMiddleware("admin", messagesListHandler))
+	mux.HandleFunc("/api/messages/", authMiddleware("admin", messagesDeleteHandler))
+	mux.HandleFunc("/api/agents/register", authMiddleware("agents:write", agentsRegisterHandler))
+	mux.HandleFunc("/api/agents/heartbeat", authMiddleware("agents:write", agentsHeartbeatHandler))
+	mux.HandleFunc("/api/agents/", authMiddleware("agents:write", agentsDeleteHandler))
+	mux.HandleFunc("/api/send/forward", authMiddleware("send", sendForwardHandler))
+	mux.HandleFunc("/api/stream", authMiddleware("admin", streamHandler))
+	mux.HandleFunc("/api/connections", authMiddleware("admin", connectionsHandler))
+	mux.HandleFunc("/api/traffic", authMiddleware("admin", trafficStatsHandler))
+	mux.HandleFunc("/api/livez", livezHandler)
+	mux.HandleFunc("/api/readyz", authMiddleware("", readyzHandler))
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/api/auth/token", authMiddleware("admin", authTokenHandler))
+	mux.HandleFunc("/api/auth/refresh", authMiddleware("", authRefreshHandler))
+
+	if err := router.ReloadFromFile(rulesFilePath()); err != nil {
+		log.Printf("no rules loaded from %s, using default transform chain: %v", rulesFilePath(), err)
+	}
+
+	fileStore, err := NewFileStore(dataDirPath())
+	if err != nil {
+		log.Fatalf("could not open store at %s: %v", dataDirPath(), err)
+	}
+	store = fileStore
+	replayPending(store)
 
 	port := "5000"
 	if p := os.Getenv("PORT"); p != "" {
@@ -175,20 +231,65 @@ func main() {
 	}
 	addr := ":" + port
 
+	registry.Register(RegisteredAgent{
+		ID:   "harshit-go-agent",
+		Name: "nanda-go-agent",
+		URL:  "http://localhost:" + port,
+	})
+	go func() {
+		ticker := time.NewTicker(1 * time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			registry.evictExpired()
+		}
+	}()
+	startFederation(peerHosts())
+	bootstrapAdminToken()
+
 	certFile := os.Getenv("CERT_FILE")
 	keyFile := os.Getenv("KEY_FILE")
 
-	if certFile != "" && keyFile != "" {
-		log.Printf("NANDA-Go agent listening (HTTPS) on %s", addr)
-		log.Printf("Endpoints: GET /api/health | POST /api/send | GET /api/render | GET /api/agents/list")
-		if err := http.ListenAndServeTLS(addr, certFile, keyFile, mux); err != nil {
-			log.Fatal(err)
+	srv := newServer(addr, mux)
+
+	endpoints := "Endpoints: GET /api/health | POST /api/send | GET /api/render | GET /api/agents/list | POST /api/rules/reload | GET /api/messages | DELETE /api/messages/<seq> | POST /api/agents/register | POST /api/agents/heartbeat | DELETE /api/agents/<id> | POST /api/send/forward | GET /api/stream (ws) | GET /api/connections | GET /api/traffic | GET /api/livez | GET /api/readyz | GET /metrics | POST /api/auth/token | POST /api/auth/refresh"
+
+	serve := func() error {
+		if certFile != "" && keyFile != "" {
+			watcherCtx, cancelWatcher := context.WithCancel(context.Background())
+			defer cancelWatcher()
+			cw, err := newCertWatcher(certFile, keyFile)
+			if err != nil {
+				return err
+			}
+			srv.TLSConfig = &tls.Config{GetCertificate: cw.GetCertificate}
+			go cw.watch(watcherCtx, tlsWatchInterval())
+
+			log.Printf("NANDA-Go agent listening (HTTPS) on %s", addr)
+			log.Print(endpoints)
+			return srv.ListenAndServeTLS("", "")
 		}
-	} else {
 		log.Printf("NANDA-Go agent listening (HTTP) on %s", addr)
-		log.Printf("Endpoints: GET /api/health | POST /api/send | GET /api/render | GET /api/agents/list")
-		if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Print(endpoints)
+		return srv.ListenAndServe()
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- serve() }()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-errCh:
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
+	case sig := <-sigCh:
+		log.Printf("received %s, shutting down (grace period %s)", sig, shutdownGrace())
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace())
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("graceful shutdown failed: %v", err)
+		}
 	}
 }
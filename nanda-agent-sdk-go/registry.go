@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RegisteredAgent is one entry in the mesh-wide agent Registry.
+type RegisteredAgent struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	URL          string    `json:"url"`
+	Capabilities []string  `json:"capabilities,omitempty"`
+	TTLSec       int       `json:"ttl_sec"`
+	RegisteredAt time.Time `json:"registered_at"`
+	LastSeen     time.Time `json:"last_seen"`
+	Source       string    `json:"source,omitempty"` // "" for locally-registered, else the peer host it was pulled from
+}
+
+func (a RegisteredAgent) expired(now time.Time) bool {
+	if a.TTLSec <= 0 {
+		return false
+	}
+	return now.Sub(a.LastSeen) > time.Duration(a.TTLSec)*time.Second
+}
+
+// Registry tracks agents known to this node, both registered locally and
+// pulled in from peer registries. Expired entries are evicted by a
+// background sweep rather than on read, so List stays cheap.
+type Registry struct {
+	mu     sync.RWMutex
+	agents map[string]RegisteredAgent
+}
+
+// NewRegistry returns an empty Registry seeded with this agent's own entry.
+func NewRegistry() *Registry {
+	return &Registry{agents: map[string]RegisteredAgent{}}
+}
+
+func (reg *Registry) Register(a RegisteredAgent) {
+	now := time.Now()
+	a.RegisteredAt = now
+	a.LastSeen = now
+	if a.TTLSec <= 0 {
+		a.TTLSec = 300
+	}
+	reg.mu.Lock()
+	reg.agents[a.ID] = a
+	reg.mu.Unlock()
+}
+
+// Heartbeat refreshes LastSeen for an already-registered agent.
+func (reg *Registry) Heartbeat(id string) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	a, ok := reg.agents[id]
+	if !ok {
+		return fmt.Errorf("unknown agent %q", id)
+	}
+	a.LastSeen = time.Now()
+	reg.agents[id] = a
+	return nil
+}
+
+func (reg *Registry) Remove(id string) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.agents[id]; !ok {
+		return false
+	}
+	delete(reg.agents, id)
+	return true
+}
+
+func (reg *Registry) Get(id string) (RegisteredAgent, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	a, ok := reg.agents[id]
+	return a, ok
+}
+
+// List returns all known, non-expired agents.
+func (reg *Registry) List() []RegisteredAgent {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	now := time.Now()
+	out := make([]RegisteredAgent, 0, len(reg.agents))
+	for _, a := range reg.agents {
+		if !a.expired(now) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// evictExpired removes entries past their TTL. Runs on a ticker from main.
+func (reg *Registry) evictExpired() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	now := time.Now()
+	for id, a := range reg.agents {
+		if a.expired(now) {
+			delete(reg.agents, id)
+		}
+	}
+}
+
+// mergeForeign replaces all entries previously pulled from source with a
+// freshly-fetched set, prefixing their ids to avoid collisions with locally
+// registered or other peers' agents.
+func (reg *Registry) mergeForeign(source string, fetched []RegisteredAgent) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for id, a := range reg.agents {
+		if a.Source == source {
+			delete(reg.agents, id)
+		}
+	}
+	now := time.Now()
+	for _, a := range fetched {
+		a.Source = source
+		a.ID = source + ":" + a.ID
+		a.LastSeen = now
+		reg.agents[a.ID] = a
+	}
+}
+
+var registry = NewRegistry()
+
+// peerHosts returns the configured upstream registries to federate with,
+// e.g. PEERS="https://host-a:5000,https://host-b:5000".
+func peerHosts() []string {
+	v := os.Getenv("PEERS")
+	if v == "" {
+		return nil
+	}
+	var peers []string
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// peerSyncInterval returns how often to pull peer registries, default 30s.
+func peerSyncInterval() time.Duration {
+	if v := os.Getenv("PEER_SYNC_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return 30 * time.Second
+}
+
+// startFederation pulls each peer's /api/agents/list on an interval and
+// merges the results into registry, prefixed by peer host.
+func startFederation(peers []string) {
+	if len(peers) == 0 {
+		return
+	}
+	interval := peerSyncInterval()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for _, peer := range peers {
+				syncPeer(peer)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+func syncPeer(peer string) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(peer, "/")+"/api/agents/list", nil)
+	if err != nil {
+		log.Printf("federation: bad peer URL %s: %v", peer, err)
+		return
+	}
+	if token := meshToken("agents:read"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("federation: could not reach peer %s: %v", peer, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("federation: peer %s returned %s", peer, resp.Status)
+		return
+	}
+	var agents []RegisteredAgent
+	if err := json.NewDecoder(resp.Body).Decode(&agents); err != nil {
+		log.Printf("federation: bad response from peer %s: %v", peer, err)
+		return
+	}
+	registry.mergeForeign(peer, agents)
+}
+
+func agentsRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var a RegisteredAgent
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if a.ID == "" || a.URL == "" {
+		http.Error(w, "id and url are required", http.StatusBadRequest)
+		return
+	}
+	registry.Register(a)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+func agentsHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if err := registry.Heartbeat(req.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func agentsDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/agents/")
+	if !registry.Remove(id) {
+		http.Error(w, "unknown agent", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sendForwardHandler looks up a target agent by id and proxies the
+// SendRequest to its /api/send, returning the remote SendResponse verbatim.
+func sendForwardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		AgentID string `json:"agent_id"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	target, ok := registry.Get(req.AgentID)
+	if !ok {
+		http.Error(w, "unknown agent", http.StatusNotFound)
+		return
+	}
+
+	body, _ := json.Marshal(SendRequest{Message: req.Message})
+	fwdReq, err := http.NewRequest(http.MethodPost, strings.TrimRight(target.URL, "/")+"/api/send", bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, "forward failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	fwdReq.Header.Set("Content-Type", "application/json")
+	if token := meshToken("send"); token != "" {
+		fwdReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(fwdReq)
+	if err != nil {
+		http.Error(w, "forward failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		http.Error(w, fmt.Sprintf("%s returned %s: %s", req.AgentID, resp.Status, respBody), http.StatusBadGateway)
+		return
+	}
+
+	var out SendResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		http.Error(w, "bad response from "+req.AgentID, http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
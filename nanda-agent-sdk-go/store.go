@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MessageStatus tracks where a stored message is in its processing lifecycle.
+type MessageStatus string
+
+const (
+	StatusPending MessageStatus = "pending"
+	StatusDone    MessageStatus = "done"
+	StatusFailed  MessageStatus = "failed"
+)
+
+// StoredMessage is one segment file's worth of persisted state for a single
+// inbound SendRequest.
+type StoredMessage struct {
+	Seq         int64         `json:"seq"`
+	TS          time.Time     `json:"ts"`
+	SourceAgent string        `json:"source_agent,omitempty"`
+	Input       string        `json:"input"`
+	Output      string        `json:"output,omitempty"`
+	Status      MessageStatus `json:"status"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// Store persists inbound messages before they run through the pipeline, so a
+// crash mid-processing can be detected and replayed on the next startup.
+type Store interface {
+	// Put writes msg (creating or overwriting its segment file) and returns it.
+	Put(msg StoredMessage) error
+	// List returns stored messages with Seq > since, oldest first, capped at limit.
+	List(since int64, limit int) ([]StoredMessage, error)
+	// Get returns a single message by sequence number.
+	Get(seq int64) (StoredMessage, error)
+	// Delete evicts a message by sequence number.
+	Delete(seq int64) error
+	// NextSeq returns the next monotonic sequence number to assign.
+	NextSeq() int64
+	// Expire deletes messages older than ttl, returning how many were removed.
+	Expire(ttl time.Duration) (int, error)
+	// Size returns the number of messages currently held.
+	Size() int
+}
+
+// FileStore is the default Store: one JSON file per message under dataDir,
+// named by zero-padded sequence number. An in-memory index avoids re-reading
+// the directory on every request; each segment has its own lock so concurrent
+// sendHandler calls for different messages don't serialize on a single mutex.
+type FileStore struct {
+	dataDir string
+
+	mu      sync.RWMutex // protects index and seq
+	index   map[int64]string
+	seq     int64
+	segLock sync.Map // seq -> *sync.Mutex, held while a segment file is written
+}
+
+// NewFileStore creates dataDir if needed and scans it to rebuild the index
+// and the monotonic sequence counter.
+func NewFileStore(dataDir string) (*FileStore, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+	fs := &FileStore{dataDir: dataDir, index: map[int64]string{}}
+	if err := fs.scan(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *FileStore) segPath(seq int64) string {
+	return filepath.Join(fs.dataDir, fmt.Sprintf("%020d.json", seq))
+}
+
+func (fs *FileStore) scan() error {
+	entries, err := os.ReadDir(fs.dataDir)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		seqStr := strings.TrimSuffix(e.Name(), ".json")
+		seq, err := strconv.ParseInt(seqStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		fs.index[seq] = filepath.Join(fs.dataDir, e.Name())
+		if seq > fs.seq {
+			fs.seq = seq
+		}
+	}
+	return nil
+}
+
+func (fs *FileStore) lockFor(seq int64) *sync.Mutex {
+	l, _ := fs.segLock.LoadOrStore(seq, &sync.Mutex{})
+	return l.(*sync.Mutex)
+}
+
+// NextSeq atomically reserves and returns the next sequence number.
+func (fs *FileStore) NextSeq() int64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.seq++
+	return fs.seq
+}
+
+func (fs *FileStore) Put(msg StoredMessage) error {
+	l := fs.lockFor(msg.Seq)
+	l.Lock()
+	defer l.Unlock()
+
+	path := fs.segPath(msg.Seq)
+	b, err := json.MarshalIndent(msg, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	fs.index[msg.Seq] = path
+	fs.mu.Unlock()
+	return nil
+}
+
+func (fs *FileStore) Get(seq int64) (StoredMessage, error) {
+	fs.mu.RLock()
+	path, ok := fs.index[seq]
+	fs.mu.RUnlock()
+	if !ok {
+		return StoredMessage{}, fmt.Errorf("no message with seq %d", seq)
+	}
+	return readSegment(path)
+}
+
+func readSegment(path string) (StoredMessage, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	var msg StoredMessage
+	if err := json.Unmarshal(b, &msg); err != nil {
+		return StoredMessage{}, err
+	}
+	return msg, nil
+}
+
+func (fs *FileStore) List(since int64, limit int) ([]StoredMessage, error) {
+	fs.mu.RLock()
+	seqs := make([]int64, 0, len(fs.index))
+	for seq := range fs.index {
+		if seq > since {
+			seqs = append(seqs, seq)
+		}
+	}
+	paths := make(map[int64]string, len(fs.index))
+	for k, v := range fs.index {
+		paths[k] = v
+	}
+	fs.mu.RUnlock()
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	if limit > 0 && len(seqs) > limit {
+		seqs = seqs[:limit]
+	}
+
+	out := make([]StoredMessage, 0, len(seqs))
+	for _, seq := range seqs {
+		msg, err := readSegment(paths[seq])
+		if err != nil {
+			continue
+		}
+		out = append(out, msg)
+	}
+	return out, nil
+}
+
+func (fs *FileStore) Delete(seq int64) error {
+	fs.mu.Lock()
+	path, ok := fs.index[seq]
+	if ok {
+		delete(fs.index, seq)
+	}
+	fs.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no message with seq %d", seq)
+	}
+	fs.segLock.Delete(seq)
+	return os.Remove(path)
+}
+
+// Size returns the number of messages currently held.
+func (fs *FileStore) Size() int {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return len(fs.index)
+}
+
+func (fs *FileStore) Expire(ttl time.Duration) (int, error) {
+	cutoff := time.Now().Add(-ttl)
+	msgs, err := fs.List(0, 0)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, msg := range msgs {
+		if msg.TS.Before(cutoff) {
+			if err := fs.Delete(msg.Seq); err == nil {
+				removed++
+			}
+		}
+	}
+	return removed, nil
+}
+
+// dataDirPath returns the configured persistence directory, defaulting to
+// "data" in the working directory.
+func dataDirPath() string {
+	if d := os.Getenv("DATA_DIR"); d != "" {
+		return d
+	}
+	return "data"
+}
+
+// storeTTL returns the configured message expiry window, defaulting to 72h.
+func storeTTL() time.Duration {
+	if v := os.Getenv("STORE_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return 72 * time.Hour
+}
+
+// replayPending runs every StatusPending entry back through the pipeline on
+// startup, so a crash between Put and the chain finishing isn't silent data
+// loss. It then launches a background goroutine that periodically expires
+// entries older than storeTTL().
+func replayPending(store Store) {
+	msgs, err := store.List(0, 0)
+	if err != nil {
+		log.Printf("replay: could not list store: %v", err)
+		return
+	}
+	replayed := 0
+	for _, msg := range msgs {
+		if msg.Status != StatusPending {
+			continue
+		}
+		chain := router.Route(msg.SourceAgent, msg.Input)
+		out, err := Run(context.Background(), chain, msg.Input)
+		if err != nil {
+			msg.Status = StatusFailed
+			msg.Error = err.Error()
+		} else {
+			msg.Status = StatusDone
+			msg.Output = out
+		}
+		if err := store.Put(msg); err != nil {
+			log.Printf("replay: could not persist seq %d: %v", msg.Seq, err)
+			continue
+		}
+		replayed++
+	}
+	if replayed > 0 {
+		log.Printf("replay: recovered %d pending message(s) from %s", replayed, dataDirPath())
+	}
+
+	go func() {
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			if n, err := store.Expire(storeTTL()); err != nil {
+				log.Printf("expire: %v", err)
+			} else if n > 0 {
+				log.Printf("expire: evicted %d message(s) older than %s", n, storeTTL())
+			}
+		}
+	}()
+}
+
+func messagesListHandler(w http.ResponseWriter, r *http.Request) {
+	since := int64(0)
+	if v := r.URL.Query().Get("since"); v != "" {
+		if parsed, err := strconv.ParseInt(v, 10, 64); err == nil {
+			since = parsed
+		}
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			limit = parsed
+		}
+	}
+	msgs, err := store.List(since, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msgs)
+}
+
+func messagesDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	seqStr := strings.TrimPrefix(r.URL.Path, "/api/messages/")
+	seq, err := strconv.ParseInt(seqStr, 10, 64)
+	if err != nil {
+		http.Error(w, "bad sequence id", http.StatusBadRequest)
+		return
+	}
+	if err := store.Delete(seq); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
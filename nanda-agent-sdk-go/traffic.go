@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TrafficEvent describes one message observed passing through sendHandler.
+type TrafficEvent struct {
+	Seq        int64  `json:"seq"`
+	TS         int64  `json:"ts"`
+	Input      string `json:"input"`
+	Output     string `json:"output"`
+	Processor  string `json:"processor"`
+	DurationMS int64  `json:"duration_ms"`
+	ClientIP   string `json:"client_ip"`
+	BytesIn    int64  `json:"bytes_in"`
+	BytesOut   int64  `json:"bytes_out"`
+}
+
+// connSubscriber is one live /api/stream websocket connection.
+type connSubscriber struct {
+	id          int64
+	clientIP    string
+	connectedAt time.Time
+	events      chan TrafficEvent
+}
+
+const subscriberBuffer = 32
+const ringBufferSize = 256
+
+// TrafficController observes every message through sendHandler and fans it
+// out to /api/stream subscribers, keeps a ring buffer for renderHandler and
+// replay-on-connect, and tracks rolling send rates. It is a plain struct (not
+// a package singleton) so tests can construct one and assert against it.
+type TrafficController struct {
+	mu          sync.Mutex
+	subscribers map[int64]*connSubscriber
+	nextSubID   int64
+
+	ring     [ringBufferSize]TrafficEvent
+	ringNext int
+	ringLen  int
+
+	buckets map[int64]*trafficBucket // unix-second -> counters, pruned to the last 60s
+}
+
+// trafficBucket holds one second's worth of traffic counters.
+type trafficBucket struct {
+	messages int
+	bytesIn  int64
+	bytesOut int64
+}
+
+// NewTrafficController returns an empty, ready-to-use controller.
+func NewTrafficController() *TrafficController {
+	return &TrafficController{
+		subscribers: map[int64]*connSubscriber{},
+		buckets:     map[int64]*trafficBucket{},
+	}
+}
+
+// Observe records ev in the ring buffer, rate buckets, and pushes it to every
+// subscriber. A subscriber whose buffer is full is skipped rather than
+// blocking the caller, which runs on the sendHandler hot path.
+func (tc *TrafficController) Observe(ev TrafficEvent) {
+	tc.mu.Lock()
+	tc.ring[tc.ringNext] = ev
+	tc.ringNext = (tc.ringNext + 1) % ringBufferSize
+	if tc.ringLen < ringBufferSize {
+		tc.ringLen++
+	}
+	sec := time.Now().Unix()
+	b, ok := tc.buckets[sec]
+	if !ok {
+		b = &trafficBucket{}
+		tc.buckets[sec] = b
+	}
+	b.messages++
+	b.bytesIn += ev.BytesIn
+	b.bytesOut += ev.BytesOut
+	for k := range tc.buckets {
+		if sec-k > 60 {
+			delete(tc.buckets, k)
+		}
+	}
+	subs := make([]*connSubscriber, 0, len(tc.subscribers))
+	for _, s := range tc.subscribers {
+		subs = append(subs, s)
+	}
+	tc.mu.Unlock()
+
+	for _, s := range subs {
+		select {
+		case s.events <- ev:
+		default:
+			// slow consumer; drop this event rather than block the hot path
+		}
+	}
+}
+
+// Latest returns the most recently observed event's output, or "" if none.
+func (tc *TrafficController) Latest() string {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.ringLen == 0 {
+		return ""
+	}
+	idx := (tc.ringNext - 1 + ringBufferSize) % ringBufferSize
+	return tc.ring[idx].Output
+}
+
+// Rate returns the message count observed in the last `window`.
+func (tc *TrafficController) Rate(window time.Duration) int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	now := time.Now().Unix()
+	cutoff := now - int64(window.Seconds())
+	count := 0
+	for sec, b := range tc.buckets {
+		if sec > cutoff {
+			count += b.messages
+		}
+	}
+	return count
+}
+
+// ByteRates returns the total bytes in/out observed in the last `window`.
+func (tc *TrafficController) ByteRates(window time.Duration) (bytesIn, bytesOut int64) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	now := time.Now().Unix()
+	cutoff := now - int64(window.Seconds())
+	for sec, b := range tc.buckets {
+		if sec > cutoff {
+			bytesIn += b.bytesIn
+			bytesOut += b.bytesOut
+		}
+	}
+	return bytesIn, bytesOut
+}
+
+func (tc *TrafficController) subscribe(clientIP string) *connSubscriber {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.nextSubID++
+	s := &connSubscriber{
+		id:          tc.nextSubID,
+		clientIP:    clientIP,
+		connectedAt: time.Now(),
+		events:      make(chan TrafficEvent, subscriberBuffer),
+	}
+	tc.subscribers[s.id] = s
+	return s
+}
+
+func (tc *TrafficController) unsubscribe(id int64) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	// Only delete from the map; do not close s.events. Observe() snapshots
+	// the subscriber list before dropping tc.mu, so a send to this channel
+	// can still be in flight here, and a send on a closed channel panics
+	// unconditionally (select/default only skips sends that would block).
+	// The channel and its goroutine are garbage once streamHandler returns.
+	delete(tc.subscribers, id)
+}
+
+// connections returns metadata about currently-open /api/stream subscribers.
+func (tc *TrafficController) connections() []map[string]any {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	out := make([]map[string]any, 0, len(tc.subscribers))
+	for _, s := range tc.subscribers {
+		out = append(out, map[string]any{
+			"id":           s.id,
+			"client_ip":    s.clientIP,
+			"connected_at": s.connectedAt,
+		})
+	}
+	return out
+}
+
+var traffic = NewTrafficController()
+
+const wsMagic = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// streamHandler upgrades the connection to a websocket and streams
+// TrafficEvents to it as JSON text frames until the client disconnects.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "expected websocket upgrade", http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	accept := wsAccept(key)
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"
+	if _, err := bufrw.WriteString(resp); err != nil {
+		return
+	}
+	if err := bufrw.Flush(); err != nil {
+		return
+	}
+
+	sub := traffic.subscribe(r.RemoteAddr)
+	defer traffic.unsubscribe(sub.id)
+
+	// Drain client frames on a separate goroutine purely to detect disconnect;
+	// this agent doesn't act on inbound websocket messages.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		buf := make([]byte, 512)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case ev, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if err := writeWSTextFrame(conn, b); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func wsAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsMagic))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// writeWSTextFrame writes payload as a single unmasked, unfragmented
+// websocket text frame (RFC 6455 section 5.2). Server-to-client frames must
+// not be masked.
+func writeWSTextFrame(conn net.Conn, payload []byte) error {
+	var header []byte
+	n := len(payload)
+	switch {
+	case n <= 125:
+		header = []byte{0x81, byte(n)}
+	case n <= 65535:
+		header = []byte{0x81, 126, byte(n >> 8), byte(n)}
+	default:
+		header = []byte{0x81, 127,
+			byte(n >> 56), byte(n >> 48), byte(n >> 40), byte(n >> 32),
+			byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	if _, err := conn.Write(header); err != nil {
+		return err
+	}
+	_, err := conn.Write(payload)
+	return err
+}
+
+func connectionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(traffic.connections())
+}
+
+func trafficStatsHandler(w http.ResponseWriter, r *http.Request) {
+	in1, out1 := traffic.ByteRates(1 * time.Second)
+	in10, out10 := traffic.ByteRates(10 * time.Second)
+	in60, out60 := traffic.ByteRates(60 * time.Second)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"messages_per_sec_1s":   traffic.Rate(1 * time.Second),
+		"messages_per_sec_10s":  float64(traffic.Rate(10*time.Second)) / 10,
+		"messages_per_sec_60s":  float64(traffic.Rate(60*time.Second)) / 60,
+		"bytes_in_per_sec_1s":   float64(in1),
+		"bytes_in_per_sec_10s":  float64(in10) / 10,
+		"bytes_in_per_sec_60s":  float64(in60) / 60,
+		"bytes_out_per_sec_1s":  float64(out1),
+		"bytes_out_per_sec_10s": float64(out10) / 10,
+		"bytes_out_per_sec_60s": float64(out60) / 60,
+	})
+}
+
+// clientIP extracts the request's remote address without its port, falling
+// back to the raw value if it can't be split.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
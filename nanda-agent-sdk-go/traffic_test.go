@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTrafficControllerObserveAndLatest(t *testing.T) {
+	tc := NewTrafficController()
+	if got := tc.Latest(); got != "" {
+		t.Fatalf("Latest() on empty controller = %q, want empty", got)
+	}
+
+	tc.Observe(TrafficEvent{Seq: 1, Output: "first"})
+	tc.Observe(TrafficEvent{Seq: 2, Output: "second"})
+
+	if got := tc.Latest(); got != "second" {
+		t.Fatalf("Latest() = %q, want %q", got, "second")
+	}
+	if got := tc.Rate(time.Minute); got != 2 {
+		t.Fatalf("Rate(1m) = %d, want 2", got)
+	}
+}
+
+func TestTrafficControllerByteRates(t *testing.T) {
+	tc := NewTrafficController()
+	tc.Observe(TrafficEvent{Seq: 1, BytesIn: 10, BytesOut: 20})
+	tc.Observe(TrafficEvent{Seq: 2, BytesIn: 5, BytesOut: 15})
+
+	in, out := tc.ByteRates(time.Minute)
+	if in != 15 {
+		t.Fatalf("ByteRates(1m) bytesIn = %d, want 15", in)
+	}
+	if out != 35 {
+		t.Fatalf("ByteRates(1m) bytesOut = %d, want 35", out)
+	}
+}
+
+func TestTrafficControllerSubscribeReceivesEvents(t *testing.T) {
+	tc := NewTrafficController()
+	sub := tc.subscribe("127.0.0.1")
+	defer tc.unsubscribe(sub.id)
+
+	tc.Observe(TrafficEvent{Seq: 1, Output: "hello"})
+
+	select {
+	case ev := <-sub.events:
+		if ev.Output != "hello" {
+			t.Fatalf("got event output %q, want %q", ev.Output, "hello")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscriber did not receive observed event")
+	}
+}
+
+// TestUnsubscribeDuringObserveDoesNotPanic reproduces the crash a live
+// /api/stream client triggered by disconnecting while a message was in
+// flight through sendHandler: Observe() snapshots subscribers and then
+// sends outside the lock, so unsubscribe() must never close a channel a
+// send might still land on.
+func TestUnsubscribeDuringObserveDoesNotPanic(t *testing.T) {
+	tc := NewTrafficController()
+	sub := tc.subscribe("127.0.0.1")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	stop := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				tc.Observe(TrafficEvent{Seq: 1, Output: "x"})
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		tc.unsubscribe(sub.id)
+	}()
+
+	// Drain sub.events so a full buffer can't mask a would-be panic behind
+	// select/default.
+	go func() {
+		for range sub.events {
+		}
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+}